@@ -0,0 +1,80 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +deepequal-gen=true
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:categories={cilium},singular="ciliumeniconfig",path="ciliumeniconfigs",scope=Namespaced,shortName={ceniconfig}
+//
+// CiliumENIConfig overrides the ENI creation parameters (subnet, security
+// groups, availability zone) that the AWS ENI allocator would otherwise
+// derive from the CiliumNode spec, for the nodes it is matched against via
+// NodeSelector. It is looked up by the node's namespace and labels, similar
+// to the ENIConfig CRD used by the upstream AWS VPC CNI.
+type CiliumENIConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is the desired ENI creation parameters for matched nodes
+	//
+	// +kubebuilder:validation:Optional
+	Spec CiliumENIConfigSpec `json:"spec,omitempty"`
+}
+
+// CiliumENIConfigSpec is the ENI creation override applied to nodes matched
+// by a CiliumENIConfig
+type CiliumENIConfigSpec struct {
+	// NodeSelector restricts which nodes this configuration applies to. An
+	// empty selector matches all nodes in the CiliumENIConfig's namespace.
+	//
+	// +kubebuilder:validation:Optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// SubnetID is the subnet to create new ENIs in. Overrides the subnet
+	// that would otherwise be resolved via FindSubnetByTags.
+	//
+	// +kubebuilder:validation:Optional
+	SubnetID string `json:"subnet-id,omitempty"`
+
+	// SecurityGroups is the list of security group IDs to attach to new
+	// ENIs created for matched nodes
+	//
+	// +kubebuilder:validation:Optional
+	SecurityGroups []string `json:"security-groups,omitempty"`
+
+	// AvailabilityZone overrides the availability zone new ENIs are
+	// created in
+	//
+	// +kubebuilder:validation:Optional
+	AvailabilityZone string `json:"availability-zone,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+//
+// CiliumENIConfigList is a list of CiliumENIConfig objects
+type CiliumENIConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	// Items is a list of CiliumENIConfig
+	Items []CiliumENIConfig `json:"items"`
+}
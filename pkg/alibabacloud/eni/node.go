@@ -0,0 +1,327 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+)
+
+const fieldName = logfields.NodeName
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "alibabacloud-eni")
+
+const (
+	// maxAttachedENIs is a conservative fallback for the number of ENIs an
+	// ECS instance can have attached, used in the absence of a
+	// per-instance-type ENI limits table
+	maxAttachedENIs = 4
+
+	// maxAddressesPerENI is a conservative fallback for the number of
+	// secondary private IPs a single ENI can hold
+	maxAddressesPerENI = 10
+)
+
+// nodeStats tracks the allocation state of a single node, mirroring the
+// bookkeeping the AWS ENI allocator keeps per CiliumNode.
+type nodeStats struct {
+	usedIPs             int
+	availableIPs        int
+	neededIPs           int
+	remainingInterfaces int
+}
+
+// addressState records whether a secondary IP attached to an ENI is
+// currently in use, and since when it has been idle if not
+type addressState struct {
+	idle      bool
+	idleSince time.Time
+}
+
+// eniState is the subset of an attached ENI's bookkeeping the allocator
+// needs: the secondary IPs hanging off of it and how long they've been idle
+type eniState struct {
+	id        string
+	addresses map[string]*addressState
+
+	// pendingAddresses counts secondary IPs requested via
+	// AssignPrivateIPAddresses that haven't shown up in addresses yet
+	// (recalculateLocked only learns of them on the next poll of the ECS
+	// API). It is consulted by availableSlotsLocked so that a deficit
+	// spanning multiple ResolveIPDeficit calls within the same resync
+	// doesn't keep re-selecting an ENI that has already been asked to fill
+	// its remaining slots, and is cleared on the next recalculateLocked
+	// once the real address list supersedes it.
+	pendingAddresses int
+}
+
+// Node manages the ENIs and secondary IPs of an AlibabaCloud ECS instance
+type Node struct {
+	mutex    lock.RWMutex
+	name     string
+	manager  *NodeManager
+	resource *v2.CiliumNode
+
+	stats        nodeStats
+	resyncNeeded bool
+
+	// enis indexes the ENIs currently attached to the instance by ENI ID
+	enis map[string]*eniState
+}
+
+func (n *Node) logger() *logrus.Entry {
+	if n == nil {
+		return log
+	}
+	return log.WithField(fieldName, n.name)
+}
+
+func (n *Node) loggerLocked() *logrus.Entry {
+	return n.logger()
+}
+
+// updatedResource is called whenever the CiliumNode custom resource for this
+// node has been updated. It triggers a resync of the allocation state and
+// returns true if an IP deficit resolution round should be scheduled.
+func (n *Node) updatedResource(resource *v2.CiliumNode) bool {
+	n.mutex.Lock()
+	n.resource = resource
+	n.resyncNeeded = true
+	n.mutex.Unlock()
+
+	n.manager.resyncTrigger.TriggerWithReason(n.name)
+	return true
+}
+
+// getNeededAddresses returns the number of additional IPs this node needs to
+// satisfy its pre-allocation watermark
+func (n *Node) getNeededAddresses() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.stats.neededIPs
+}
+
+// recalculateLocked recalculates the allocation statistics for the node
+// against the latest ENI/IP state reported by the ECS API and the
+// CiliumNode resource's own watermarks. The caller must hold n.mutex.
+func (n *Node) recalculateLocked() bool {
+	if n.resource == nil {
+		return false
+	}
+	if n.enis == nil {
+		n.enis = map[string]*eniState{}
+	}
+
+	instanceID := n.resource.Spec.InstanceID
+	usedIPs := map[string]struct{}{}
+	for ip := range n.resource.Status.IPAM.Used {
+		usedIPs[ip] = struct{}{}
+	}
+
+	now := time.Now()
+	seen := map[string]struct{}{}
+	available := 0
+
+	for _, eni := range n.manager.instancesAPI.GetENIs(instanceID) {
+		state, ok := n.enis[eni.ID]
+		if !ok {
+			state = &eniState{id: eni.ID, addresses: map[string]*addressState{}}
+			n.enis[eni.ID] = state
+		}
+		// the address list below is a fresh poll of the ECS API,
+		// superseding anything ResolveIPDeficit provisionally tracked in
+		// pendingAddresses since the last recalculation
+		state.pendingAddresses = 0
+		seen[eni.ID] = struct{}{}
+
+		liveAddrs := map[string]struct{}{}
+		for _, addr := range eni.Addresses {
+			liveAddrs[addr] = struct{}{}
+
+			if _, used := usedIPs[addr]; used {
+				state.addresses[addr] = &addressState{idle: false}
+				continue
+			}
+
+			if as, tracked := state.addresses[addr]; tracked && as.idle {
+				available++
+				continue
+			}
+			state.addresses[addr] = &addressState{idle: true, idleSince: now}
+			available++
+		}
+
+		// drop addresses that are no longer attached to the ENI
+		for addr := range state.addresses {
+			if _, ok := liveAddrs[addr]; !ok {
+				delete(state.addresses, addr)
+			}
+		}
+	}
+
+	// drop ENIs that are no longer attached to the instance
+	for eniID := range n.enis {
+		if _, ok := seen[eniID]; !ok {
+			delete(n.enis, eniID)
+		}
+	}
+
+	remainingInterfaces := maxAttachedENIs - len(n.enis)
+	if remainingInterfaces < 0 {
+		remainingInterfaces = 0
+	}
+
+	n.stats.usedIPs = len(usedIPs)
+	n.stats.availableIPs = available
+	n.stats.remainingInterfaces = remainingInterfaces
+	n.stats.neededIPs = neededIPsLocked(n.resource, n.stats.usedIPs, n.stats.availableIPs)
+
+	return n.stats.neededIPs > 0
+}
+
+// neededIPsLocked returns the number of additional secondary IPs required
+// for available capacity to reach the node's pre-allocation watermark
+func neededIPsLocked(resource *v2.CiliumNode, used, available int) int {
+	needed := resource.Spec.IPAM.PreAllocate - available
+	if fromMin := resource.Spec.IPAM.MinAllocate - (used + available); fromMin > needed {
+		needed = fromMin
+	}
+	if needed < 0 {
+		needed = 0
+	}
+	return needed
+}
+
+// spareCapacityENILocked returns the ID of an attached ENI that still has
+// room for more secondary IPs, or "" if none do and a new ENI must be
+// created
+func (n *Node) spareCapacityENILocked() string {
+	for id, state := range n.enis {
+		if availableSlotsLocked(state) > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// availableSlotsLocked returns how many more secondary IPs the given ENI
+// has room for before hitting maxAddressesPerENI
+func availableSlotsLocked(state *eniState) int {
+	slots := maxAddressesPerENI - len(state.addresses) - state.pendingAddresses
+	if slots < 0 {
+		slots = 0
+	}
+	return slots
+}
+
+// createENILocked creates and attaches a new ENI for the node, resolving
+// the VSwitch to create it in from the CiliumNode spec's AlibabaCloud
+// defaults
+func (n *Node) createENILocked() (string, error) {
+	instanceID := n.resource.Spec.InstanceID
+	spec := n.resource.Spec.AlibabaCloud
+
+	vSwitch := n.manager.instancesAPI.FindVSwitchByTags(spec.VPCID, spec.ZoneID, spec.VSwitchTags)
+	if vSwitch == nil {
+		return "", fmt.Errorf("no matching VSwitch available for ENI creation")
+	}
+
+	eniID, err := n.manager.ecsAPI.CreateNetworkInterface(0, vSwitch.ID, instanceID, fmt.Sprintf("Cilium-managed ENI for %s", n.name), spec.SecurityGroupIDs)
+	if err != nil {
+		n.manager.metricsAPI.IncENIAllocationAttempt("failed", vSwitch.ID)
+		return "", fmt.Errorf("unable to create ENI: %s", err)
+	}
+
+	if err := n.manager.ecsAPI.AttachNetworkInterface(instanceID, eniID); err != nil {
+		return "", fmt.Errorf("unable to attach ENI: %s", err)
+	}
+
+	n.enis[eniID] = &eniState{id: eniID, addresses: map[string]*addressState{}}
+	n.manager.metricsAPI.IncENIAllocationAttempt("success", vSwitch.ID)
+	return eniID, nil
+}
+
+// ResolveIPDeficit allocates additional secondary IPs, creating and
+// attaching as many new ENIs via the ECS API as needed when no attached
+// ENI has spare capacity. Each ENI is only ever asked for as many
+// addresses as it actually has free slots for; a deficit too large for a
+// single ENI spills over onto additional ENIs rather than being crammed
+// onto one.
+func (n *Node) ResolveIPDeficit() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stats.neededIPs == 0 {
+		return nil
+	}
+
+	remaining := n.stats.neededIPs
+
+	for remaining > 0 {
+		eniID := n.spareCapacityENILocked()
+		if eniID == "" {
+			var err error
+			eniID, err = n.createENILocked()
+			if err != nil {
+				return err
+			}
+		}
+
+		state := n.enis[eniID]
+		slots := availableSlotsLocked(state)
+		if slots == 0 {
+			return fmt.Errorf("ENI %s reported spare capacity but has no available slots", eniID)
+		}
+
+		toAssign := remaining
+		if toAssign > slots {
+			toAssign = slots
+		}
+
+		if err := n.manager.ecsAPI.AssignPrivateIPAddresses(eniID, int64(toAssign)); err != nil {
+			return fmt.Errorf("unable to assign private IP addresses: %s", err)
+		}
+
+		state.pendingAddresses += toAssign
+		n.stats.availableIPs += toAssign
+		remaining -= toAssign
+	}
+
+	n.stats.neededIPs = 0
+	return nil
+}
+
+// SyncToAPIServer pushes the current allocation status of the node back to
+// the CiliumNode custom resource in the Kubernetes apiserver.
+func (n *Node) SyncToAPIServer() {
+	n.mutex.RLock()
+	resource := n.resource
+	n.mutex.RUnlock()
+
+	if resource == nil {
+		return
+	}
+
+	if _, err := n.manager.k8sAPI.UpdateStatus(resource, resource); err != nil {
+		n.logger().WithError(err).Warning("Unable to update CiliumNode status")
+	}
+}
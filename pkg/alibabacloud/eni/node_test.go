@@ -0,0 +1,99 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"testing"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestResource(preAllocate, minAllocate int) *v2.CiliumNode {
+	return &v2.CiliumNode{
+		Spec: v2.NodeSpec{
+			IPAM: v2.IPAMSpec{
+				PreAllocate: preAllocate,
+				MinAllocate: minAllocate,
+			},
+		},
+	}
+}
+
+func TestNeededIPsLocked(t *testing.T) {
+	tests := []struct {
+		name        string
+		preAllocate int
+		minAllocate int
+		used        int
+		available   int
+		want        int
+	}{
+		{"below pre-allocate watermark", 8, 0, 2, 2, 6},
+		{"at pre-allocate watermark", 8, 0, 2, 8, 0},
+		{"below min-allocate watermark", 0, 10, 1, 1, 8},
+		{"min-allocate dominates pre-allocate", 4, 10, 0, 2, 8},
+		{"nothing needed", 4, 4, 4, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := newTestResource(tt.preAllocate, tt.minAllocate)
+			got := neededIPsLocked(resource, tt.used, tt.available)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNodeSpareCapacityENILocked(t *testing.T) {
+	n := &Node{
+		enis: map[string]*eniState{
+			"eni-full": {
+				id:        "eni-full",
+				addresses: make(map[string]*addressState, maxAddressesPerENI),
+			},
+			"eni-spare": {
+				id:        "eni-spare",
+				addresses: map[string]*addressState{"10.0.0.1": {idle: true}},
+			},
+		},
+	}
+	for i := 0; i < maxAddressesPerENI; i++ {
+		n.enis["eni-full"].addresses[string(rune('a'+i))] = &addressState{idle: true}
+	}
+
+	assert.Equal(t, "eni-spare", n.spareCapacityENILocked())
+
+	delete(n.enis, "eni-spare")
+	assert.Equal(t, "", n.spareCapacityENILocked())
+}
+
+func TestAvailableSlotsLocked(t *testing.T) {
+	state := &eniState{
+		id:        "eni-a",
+		addresses: map[string]*addressState{"10.0.0.1": {idle: true}, "10.0.0.2": {idle: true}},
+	}
+	assert.Equal(t, maxAddressesPerENI-2, availableSlotsLocked(state))
+
+	state.pendingAddresses = maxAddressesPerENI
+	assert.Equal(t, 0, availableSlotsLocked(state))
+}
+
+func TestNodeGetNeededAddresses(t *testing.T) {
+	n := &Node{}
+	n.stats.neededIPs = 3
+	assert.Equal(t, 3, n.getNeededAddresses())
+}
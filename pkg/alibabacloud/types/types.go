@@ -0,0 +1,50 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package types holds the AlibabaCloud API types shared between the
+// instances cache and the ENI allocator, mirroring pkg/aws/types.
+package types
+
+// Tags is a map of tags, e.g. AlibabaCloud resource tags
+type Tags map[string]string
+
+// Match returns true if all required tags are found in the tags map
+func (t Tags) Match(required Tags) bool {
+	for k, v := range required {
+		if t[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// VSwitch represents an AlibabaCloud VSwitch, the equivalent of an AWS
+// Subnet
+type VSwitch struct {
+	// ID is the VSwitch ID
+	ID string
+
+	// VPCID is the VPC to which the VSwitch belongs
+	VPCID string
+
+	// ZoneID is the availability zone of the VSwitch
+	ZoneID string
+
+	// AvailableAddresses is the number of addresses available for
+	// allocation
+	AvailableAddresses int
+
+	// Tags is the tags associated with the VSwitch
+	Tags Tags
+}
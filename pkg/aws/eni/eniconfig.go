@@ -0,0 +1,72 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotationENIConfig is set on a Node (or CiliumNode) to pin it to a
+// specific CiliumENIConfig by name, overriding namespace-wide matching
+const annotationENIConfig = "cilium.io/eni-config"
+
+// eniConfigAPI looks up CiliumENIConfig custom resources, backed by the
+// informer registered for the CRD
+type eniConfigAPI interface {
+	// GetByName returns the CiliumENIConfig with the given namespace/name
+	GetByName(namespace, name string) (*v2.CiliumENIConfig, error)
+	// GetForNamespace returns all CiliumENIConfig objects in a namespace
+	GetForNamespace(namespace string) ([]*v2.CiliumENIConfig, error)
+}
+
+// resolveENIConfig applies the CiliumENIConfig precedence rules for a node:
+// a per-node annotation naming a specific CiliumENIConfig wins, followed by
+// any CiliumENIConfig in the node's namespace whose NodeSelector matches the
+// node's labels, falling back to nil (the CiliumNode spec's own defaults)
+// when nothing matches. It is consulted by ResolveIPDeficit before
+// instancesAPI.FindSubnetByTags/ec2API.CreateNetworkInterface so that a
+// matched override can steer which subnet/security groups/AZ a new ENI is
+// created in.
+func resolveENIConfig(api eniConfigAPI, namespace string, annotations, labels map[string]string) (*v2.CiliumENIConfig, error) {
+	if name, ok := annotations[annotationENIConfig]; ok && name != "" {
+		return api.GetByName(namespace, name)
+	}
+
+	configs, err := api.GetForNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		selector := config.Spec.NodeSelector
+		if selector == nil {
+			return config, nil
+		}
+
+		labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			log.WithError(err).WithField("ciliumENIConfig", config.Name).Warning("Invalid NodeSelector on CiliumENIConfig")
+			continue
+		}
+		if labelSelector.Matches(k8sLabels.Set(labels)) {
+			return config, nil
+		}
+	}
+
+	return nil, nil
+}
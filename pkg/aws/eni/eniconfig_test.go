@@ -0,0 +1,89 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeENIConfigAPI struct {
+	byName      map[string]*v2.CiliumENIConfig
+	byNamespace map[string][]*v2.CiliumENIConfig
+}
+
+func (f *fakeENIConfigAPI) GetByName(namespace, name string) (*v2.CiliumENIConfig, error) {
+	config, ok := f.byName[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("no such CiliumENIConfig %s/%s", namespace, name)
+	}
+	return config, nil
+}
+
+func (f *fakeENIConfigAPI) GetForNamespace(namespace string) ([]*v2.CiliumENIConfig, error) {
+	return f.byNamespace[namespace], nil
+}
+
+func TestResolveENIConfigAnnotationPrecedence(t *testing.T) {
+	pinned := &v2.CiliumENIConfig{Spec: v2.CiliumENIConfigSpec{SubnetID: "subnet-pinned"}}
+	matched := &v2.CiliumENIConfig{Spec: v2.CiliumENIConfigSpec{SubnetID: "subnet-matched"}}
+
+	api := &fakeENIConfigAPI{
+		byName: map[string]*v2.CiliumENIConfig{"kube-system/pinned": pinned},
+		byNamespace: map[string][]*v2.CiliumENIConfig{
+			"kube-system": {matched},
+		},
+	}
+
+	config, err := resolveENIConfig(api, "kube-system", map[string]string{annotationENIConfig: "pinned"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, pinned, config)
+}
+
+func TestResolveENIConfigNodeSelectorMatch(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"zone": "a"}}
+	matched := &v2.CiliumENIConfig{Spec: v2.CiliumENIConfigSpec{SubnetID: "subnet-a", NodeSelector: selector}}
+	unmatched := &v2.CiliumENIConfig{Spec: v2.CiliumENIConfigSpec{SubnetID: "subnet-b", NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"zone": "b"}}}}
+
+	api := &fakeENIConfigAPI{
+		byNamespace: map[string][]*v2.CiliumENIConfig{
+			"kube-system": {unmatched, matched},
+		},
+	}
+
+	config, err := resolveENIConfig(api, "kube-system", nil, map[string]string{"zone": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, matched, config)
+}
+
+func TestResolveENIConfigNoMatchFallsBackToNil(t *testing.T) {
+	api := &fakeENIConfigAPI{
+		byNamespace: map[string][]*v2.CiliumENIConfig{
+			"kube-system": {
+				{Spec: v2.CiliumENIConfigSpec{NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"zone": "b"}}}},
+			},
+		},
+	}
+
+	config, err := resolveENIConfig(api, "kube-system", nil, map[string]string{"zone": "a"})
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+}
@@ -0,0 +1,624 @@
+// Copyright 2019 Authors of Cilium
+// Copyright 2017 Lyft, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cilium/cilium/pkg/aws/types"
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+)
+
+const fieldName = logfields.NodeName
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "aws-eni")
+
+const (
+	// maxAttachedENIs is a conservative fallback for the number of ENIs an
+	// EC2 instance can have attached, used in the absence of a
+	// per-instance-type ENI limits table
+	maxAttachedENIs = 4
+
+	// maxAddressesPerENI is a conservative fallback for the number of
+	// secondary private IPs a single ENI can hold
+	maxAddressesPerENI = 14
+)
+
+// nitroPrefixDelegationFamilies lists the EC2 instance families known to
+// support IPv4 prefix delegation (Nitro-based instances with an ENA driver
+// new enough to support AssignPrivateIpPrefixes). Instance types outside
+// this list transparently fall back to per-IP allocation even when
+// option.AwsEnablePrefixDelegation is set.
+var nitroPrefixDelegationFamilies = map[string]struct{}{
+	"a1": {}, "c5": {}, "c5a": {}, "c5ad": {}, "c5d": {}, "c5n": {},
+	"c6g": {}, "c6gd": {}, "c6gn": {}, "c6i": {},
+	"m5": {}, "m5a": {}, "m5ad": {}, "m5d": {}, "m5dn": {}, "m5n": {}, "m5zn": {},
+	"m6g": {}, "m6gd": {}, "m6i": {},
+	"r5": {}, "r5a": {}, "r5ad": {}, "r5b": {}, "r5d": {}, "r5dn": {}, "r5n": {},
+	"r6g": {}, "r6gd": {}, "r6i": {},
+	"t3": {}, "t3a": {}, "t4g": {},
+}
+
+// instanceTypeSupportsPrefixDelegation reports whether instanceType belongs
+// to an EC2 instance family known to support IPv4 prefix delegation
+func instanceTypeSupportsPrefixDelegation(instanceType string) bool {
+	family := instanceType
+	if idx := strings.Index(instanceType, "."); idx != -1 {
+		family = instanceType[:idx]
+	}
+	_, ok := nitroPrefixDelegationFamilies[family]
+	return ok
+}
+
+// nodeStats tracks the allocation state of a single node
+type nodeStats struct {
+	usedIPs             int
+	availableIPs        int
+	neededIPs           int
+	remainingInterfaces int
+
+	// availablePrefixes is the number of IPv4 addresses made available via
+	// /28 prefixes assigned through AssignPrivateIpPrefixes, tracked
+	// separately from availableIPs so Resync can report prefix-backed
+	// capacity without double counting it as individually-assigned IPs
+	availablePrefixes int
+}
+
+// addressState records whether a secondary IP attached to an ENI is
+// currently in use, and since when it has been idle if not. Idle-since
+// tracking lets the rebalancer leave freshly-freed addresses alone for
+// RebalanceConfig.ExcessIPReleaseCooldown instead of immediately stealing them back from a
+// node that might reuse them.
+type addressState struct {
+	idle      bool
+	idleSince time.Time
+}
+
+// prefixState mirrors addressState for an entire /28 IPv4 prefix assigned
+// via AssignPrivateIpPrefixes. Unlike individually-assigned secondary IPs,
+// a prefix can only be idle or in-use as a whole: it is idle only once none
+// of its ipsPerPrefix addresses are in use, and it can only be released in
+// full via UnassignPrivateIpPrefixes.
+type prefixState struct {
+	idle      bool
+	idleSince time.Time
+}
+
+// eniState is the subset of an attached ENI's bookkeeping the rebalancer
+// and idle-ENI GC need: the addresses and prefixes hanging off of it and
+// how long they've sat unused
+type eniState struct {
+	id           string
+	attachmentID string
+	addresses    map[string]*addressState
+	prefixes     map[string]*prefixState
+
+	// pendingAddresses counts secondary IPs requested via
+	// AssignPrivateIpAddresses that haven't shown up in addresses yet
+	// (recalculateLocked only learns of them on the next poll of the EC2
+	// API). It is consulted by availableSlotsLocked so that a deficit
+	// spanning multiple ResolveIPDeficit calls within the same resync
+	// doesn't keep re-selecting an ENI that has already been asked to fill
+	// its remaining slots, and is cleared on the next recalculateLocked
+	// once the real address list supersedes it.
+	pendingAddresses int
+}
+
+// Node manages the ENIs and secondary IPs of an AWS EC2 instance
+type Node struct {
+	mutex    lock.RWMutex
+	name     string
+	manager  *NodeManager
+	resource *v2.CiliumNode
+
+	stats        nodeStats
+	resyncNeeded bool
+
+	// enis indexes the ENIs currently attached to the instance by ENI ID,
+	// used by the rebalancer and idle-ENI GC to decide which addresses are
+	// safe to reclaim
+	enis map[string]*eniState
+}
+
+func (n *Node) logger() *logrus.Entry {
+	if n == nil {
+		return log
+	}
+	return log.WithField(fieldName, n.name)
+}
+
+func (n *Node) loggerLocked() *logrus.Entry {
+	return n.logger()
+}
+
+// updatedResource is called whenever the CiliumNode custom resource for this
+// node has been updated. It triggers a resync of the allocation state and
+// returns true if an IP deficit resolution round should be scheduled.
+func (n *Node) updatedResource(resource *v2.CiliumNode) bool {
+	n.mutex.Lock()
+	n.resource = resource
+	n.resyncNeeded = true
+	n.mutex.Unlock()
+
+	n.manager.resyncTrigger.TriggerWithReason(n.name)
+	return true
+}
+
+// getNeededAddresses returns the number of additional IPs this node needs to
+// satisfy its pre-allocation watermark
+func (n *Node) getNeededAddresses() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.stats.neededIPs
+}
+
+// recalculateLocked recalculates the allocation statistics for the node
+// against the latest ENI/IP state reported by the EC2 API and the
+// CiliumNode resource's own watermarks. The caller must hold n.mutex.
+func (n *Node) recalculateLocked() bool {
+	if n.resource == nil {
+		return false
+	}
+	if n.enis == nil {
+		n.enis = map[string]*eniState{}
+	}
+
+	instanceID := n.resource.Spec.InstanceID
+	usedIPs := map[string]struct{}{}
+	for ip := range n.resource.Status.IPAM.Used {
+		usedIPs[ip] = struct{}{}
+	}
+
+	now := time.Now()
+	seen := map[string]struct{}{}
+	available := 0
+	availablePrefixes := 0
+
+	for _, eni := range n.manager.instancesAPI.GetENIs(instanceID) {
+		state, ok := n.enis[eni.ID]
+		if !ok {
+			state = &eniState{id: eni.ID, addresses: map[string]*addressState{}, prefixes: map[string]*prefixState{}}
+			n.enis[eni.ID] = state
+		}
+		// the address/prefix lists below are a fresh poll of the EC2 API,
+		// superseding anything ResolveIPDeficit provisionally tracked in
+		// pendingAddresses since the last recalculation
+		state.pendingAddresses = 0
+		seen[eni.ID] = struct{}{}
+
+		liveAddrs := map[string]struct{}{}
+		for _, addr := range eni.Addresses {
+			liveAddrs[addr] = struct{}{}
+
+			if _, used := usedIPs[addr]; used {
+				state.addresses[addr] = &addressState{idle: false}
+				continue
+			}
+
+			if as, tracked := state.addresses[addr]; tracked && as.idle {
+				available++
+				continue
+			}
+			state.addresses[addr] = &addressState{idle: true, idleSince: now}
+			available++
+		}
+
+		// drop addresses that are no longer attached to the ENI
+		for addr := range state.addresses {
+			if _, ok := liveAddrs[addr]; !ok {
+				delete(state.addresses, addr)
+			}
+		}
+
+		livePrefixes := map[string]struct{}{}
+		for _, cidr := range eni.Prefixes {
+			livePrefixes[cidr] = struct{}{}
+
+			usedInPrefix, err := usedAddressesInPrefix(cidr, usedIPs)
+			if err != nil {
+				n.loggerLocked().WithError(err).WithField("cidr", cidr).Warning("Unable to parse assigned IPv4 prefix, excluding it from available capacity")
+				continue
+			}
+
+			free := ipsPerPrefix - usedInPrefix
+			if free < 0 {
+				free = 0
+			}
+			availablePrefixes += free
+
+			switch ps, tracked := state.prefixes[cidr]; {
+			case usedInPrefix > 0:
+				state.prefixes[cidr] = &prefixState{idle: false}
+			case tracked && ps.idle:
+				// already idle, preserve idleSince
+			default:
+				state.prefixes[cidr] = &prefixState{idle: true, idleSince: now}
+			}
+		}
+
+		// drop prefixes that are no longer attached to the ENI
+		for cidr := range state.prefixes {
+			if _, ok := livePrefixes[cidr]; !ok {
+				delete(state.prefixes, cidr)
+			}
+		}
+	}
+
+	// drop ENIs that are no longer attached to the instance
+	for eniID := range n.enis {
+		if _, ok := seen[eniID]; !ok {
+			delete(n.enis, eniID)
+		}
+	}
+
+	remainingInterfaces := maxAttachedENIs - len(n.enis)
+	if remainingInterfaces < 0 {
+		remainingInterfaces = 0
+	}
+
+	n.stats.usedIPs = len(usedIPs)
+	n.stats.availableIPs = available
+	n.stats.availablePrefixes = availablePrefixes
+	n.stats.remainingInterfaces = remainingInterfaces
+	n.stats.neededIPs = neededIPsLocked(n.resource, n.stats.usedIPs, n.stats.availableIPs+n.stats.availablePrefixes)
+
+	return n.stats.neededIPs > 0
+}
+
+// usedAddressesInPrefix returns how many of usedIPs fall within the given
+// IPv4 prefix CIDR
+func usedAddressesInPrefix(cidr string, usedIPs map[string]struct{}) (int, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for addr := range usedIPs {
+		if ip := net.ParseIP(addr); ip != nil && ipNet.Contains(ip) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// neededIPsLocked returns the number of additional addresses required for
+// available capacity to reach the node's pre-allocation watermark
+func neededIPsLocked(resource *v2.CiliumNode, used, available int) int {
+	needed := resource.Spec.IPAM.PreAllocate - available
+	if fromMin := resource.Spec.IPAM.MinAllocate - (used + available); fromMin > needed {
+		needed = fromMin
+	}
+	if needed < 0 {
+		needed = 0
+	}
+	return needed
+}
+
+// spareCapacityENILocked returns the ID of an attached ENI that still has
+// room for more addresses or prefixes, or "" if none do and a new ENI must
+// be created
+func (n *Node) spareCapacityENILocked() string {
+	for id, state := range n.enis {
+		if availableSlotsLocked(state) > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// availableSlotsLocked returns how many more addresses or prefixes the
+// given ENI has room for before hitting maxAddressesPerENI
+func availableSlotsLocked(state *eniState) int {
+	slots := maxAddressesPerENI - len(state.addresses) - len(state.prefixes) - state.pendingAddresses
+	if slots < 0 {
+		slots = 0
+	}
+	return slots
+}
+
+// createENILocked creates and attaches a new ENI for the node. A
+// CiliumENIConfig matched against the node's namespace/labels takes
+// precedence over the subnet/security-group/AZ defaults carried in the
+// CiliumNode spec, mirroring the ENIConfig CRD used by the upstream AWS VPC
+// CNI.
+func (n *Node) createENILocked() (string, error) {
+	instanceID := n.resource.Spec.InstanceID
+
+	var subnet *types.Subnet
+	var securityGroups []string
+	availabilityZone := n.resource.Spec.ENI.AvailabilityZone
+
+	if n.manager.eniConfigAPI != nil {
+		config, err := resolveENIConfig(n.manager.eniConfigAPI, n.resource.Namespace, n.resource.Annotations, n.resource.Labels)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve CiliumENIConfig: %s", err)
+		}
+		if config != nil {
+			if config.Spec.SubnetID != "" {
+				subnet = n.manager.instancesAPI.GetSubnet(config.Spec.SubnetID)
+			}
+			if len(config.Spec.SecurityGroups) > 0 {
+				securityGroups = config.Spec.SecurityGroups
+			}
+			if config.Spec.AvailabilityZone != "" {
+				availabilityZone = config.Spec.AvailabilityZone
+			}
+		}
+	}
+
+	if subnet == nil {
+		subnet = n.manager.instancesAPI.FindSubnetByTags(n.resource.Spec.ENI.VpcID, availabilityZone, n.resource.Spec.ENI.SubnetTags)
+	}
+	if subnet == nil {
+		return "", fmt.Errorf("no matching subnet available for ENI creation")
+	}
+	if len(securityGroups) == 0 {
+		securityGroups = n.resource.Spec.ENI.SecurityGroups
+	}
+
+	eniID, err := n.manager.ec2API.CreateNetworkInterface(0, subnet.ID, fmt.Sprintf("Cilium-managed ENI for %s", n.name), securityGroups)
+	if err != nil {
+		n.manager.metricsAPI.IncENIAllocationAttempt("failed", subnet.ID)
+		return "", fmt.Errorf("unable to create ENI: %s", err)
+	}
+
+	attachmentID, err := n.manager.ec2API.AttachNetworkInterface(int64(len(n.enis)), instanceID, eniID)
+	if err != nil {
+		return "", fmt.Errorf("unable to attach ENI: %s", err)
+	}
+
+	n.enis[eniID] = &eniState{id: eniID, attachmentID: attachmentID, addresses: map[string]*addressState{}, prefixes: map[string]*prefixState{}}
+	n.manager.metricsAPI.IncENIAllocationAttempt("success", subnet.ID)
+	return eniID, nil
+}
+
+// ResolveIPDeficit allocates additional capacity, creating and attaching as
+// many new ENIs via the EC2 API as needed when no attached ENI has spare
+// capacity. Each ENI is only ever asked for as many addresses/prefixes as
+// it actually has free slots for; a deficit too large for a single ENI
+// spills over onto additional ENIs rather than being crammed onto one.
+// When prefix delegation is enabled and the node's instance type supports
+// it, capacity is requested as /28 IPv4 prefixes instead of individual
+// secondary IPs; instance types outside nitroPrefixDelegationFamilies fall
+// back to per-IP allocation even with prefix delegation enabled.
+func (n *Node) ResolveIPDeficit() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stats.neededIPs == 0 {
+		return nil
+	}
+
+	usePrefixes := n.manager.prefixDelegation && instanceTypeSupportsPrefixDelegation(n.resource.Spec.ENI.InstanceType)
+	remaining := n.stats.neededIPs
+
+	for remaining > 0 {
+		eniID := n.spareCapacityENILocked()
+		if eniID == "" {
+			var err error
+			eniID, err = n.createENILocked()
+			if err != nil {
+				return err
+			}
+		}
+
+		state := n.enis[eniID]
+		slots := availableSlotsLocked(state)
+		if slots == 0 {
+			return fmt.Errorf("ENI %s reported spare capacity but has no available slots", eniID)
+		}
+
+		if usePrefixes {
+			prefixesNeeded := int64((remaining + ipsPerPrefix - 1) / ipsPerPrefix)
+			if prefixesNeeded > int64(slots) {
+				prefixesNeeded = int64(slots)
+			}
+
+			cidrs, err := n.manager.ec2API.AssignPrivateIpPrefixes(eniID, prefixesNeeded)
+			if err != nil {
+				return fmt.Errorf("unable to assign private IPv4 prefixes: %s", err)
+			}
+
+			now := time.Now()
+			for _, cidr := range cidrs {
+				state.prefixes[cidr] = &prefixState{idle: true, idleSince: now}
+				n.stats.availablePrefixes += ipsPerPrefix
+			}
+			remaining -= len(cidrs) * ipsPerPrefix
+			continue
+		}
+
+		toAssign := remaining
+		if toAssign > slots {
+			toAssign = slots
+		}
+
+		if err := n.manager.ec2API.AssignPrivateIpAddresses(eniID, int64(toAssign)); err != nil {
+			return fmt.Errorf("unable to assign private IP addresses: %s", err)
+		}
+
+		state.pendingAddresses += toAssign
+		n.stats.availableIPs += toAssign
+		remaining -= toAssign
+	}
+
+	n.stats.neededIPs = 0
+	return nil
+}
+
+// SyncToAPIServer pushes the current allocation status of the node back to
+// the CiliumNode custom resource in the Kubernetes apiserver.
+func (n *Node) SyncToAPIServer() {
+	n.mutex.RLock()
+	resource := n.resource
+	n.mutex.RUnlock()
+
+	if resource == nil {
+		return
+	}
+
+	if _, err := n.manager.k8sAPI.UpdateStatus(resource, resource); err != nil {
+		n.logger().WithError(err).Warning("Unable to update CiliumNode status")
+	}
+}
+
+// unassignSurplusIPs releases, ENI by ENI, idle secondary IPs and then whole
+// idle IPv4 prefixes of that ENI, that have both: (a) pushed this node's
+// available capacity above highWatermark, and (b) been idle for at least
+// cooldown, back to the donor's subnet so a recipient node sitting at
+// capacity can pick them up on its next deficit resolution round. It
+// returns the number of addresses released, counting every address in a
+// released prefix.
+func (n *Node) unassignSurplusIPs(highWatermark int, cooldown time.Duration) (int, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	surplus := (n.stats.availableIPs + n.stats.availablePrefixes) - highWatermark
+	if surplus <= 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	released := 0
+
+	for eniID, state := range n.enis {
+		if surplus <= 0 {
+			break
+		}
+
+		var toRelease []string
+		for addr, as := range state.addresses {
+			if surplus <= 0 {
+				break
+			}
+			if as.idle && now.Sub(as.idleSince) >= cooldown {
+				toRelease = append(toRelease, addr)
+				surplus--
+			}
+		}
+		if len(toRelease) > 0 {
+			if err := n.manager.ec2API.UnassignPrivateIpAddresses(eniID, toRelease); err != nil {
+				return released, fmt.Errorf("unable to unassign IPs from ENI %s: %s", eniID, err)
+			}
+			for _, addr := range toRelease {
+				delete(state.addresses, addr)
+			}
+			released += len(toRelease)
+			n.stats.availableIPs -= len(toRelease)
+		}
+
+		var prefixesToRelease []string
+		for cidr, ps := range state.prefixes {
+			if surplus <= 0 {
+				break
+			}
+			if ps.idle && now.Sub(ps.idleSince) >= cooldown {
+				prefixesToRelease = append(prefixesToRelease, cidr)
+				surplus -= ipsPerPrefix
+			}
+		}
+		if len(prefixesToRelease) > 0 {
+			if err := n.manager.ec2API.UnassignPrivateIpPrefixes(eniID, prefixesToRelease); err != nil {
+				return released, fmt.Errorf("unable to unassign IPv4 prefixes from ENI %s: %s", eniID, err)
+			}
+			for _, cidr := range prefixesToRelease {
+				delete(state.prefixes, cidr)
+			}
+			released += len(prefixesToRelease) * ipsPerPrefix
+			n.stats.availablePrefixes -= len(prefixesToRelease) * ipsPerPrefix
+		}
+	}
+
+	return released, nil
+}
+
+// releaseIdleENIs detaches and deletes attached ENIs whose every address
+// and prefix has been idle for at least idleFor, freeing up the instance's
+// per-ENI quota for future allocations. An ENI with nothing attached at all
+// (e.g. one unassignSurplusIPs just drained down to zero) is deleted
+// immediately rather than waiting out idleFor, since there is nothing left
+// on it to have been "recently" idle.
+func (n *Node) releaseIdleENIs(idleFor time.Duration) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+
+	for eniID, state := range n.enis {
+		empty := len(state.addresses) == 0 && len(state.prefixes) == 0
+
+		if !empty {
+			idleSince, allIdle := eniIdleSinceLocked(state)
+			if !allIdle || now.Sub(idleSince) < idleFor {
+				continue
+			}
+		}
+
+		if err := n.manager.ec2API.DetachNetworkInterface(state.attachmentID); err != nil {
+			return fmt.Errorf("unable to detach idle ENI %s: %s", eniID, err)
+		}
+
+		if err := n.manager.ec2API.DeleteNetworkInterface(eniID); err != nil {
+			return fmt.Errorf("unable to delete idle ENI %s: %s", eniID, err)
+		}
+
+		n.stats.availableIPs -= len(state.addresses)
+		n.stats.availablePrefixes -= len(state.prefixes) * ipsPerPrefix
+		delete(n.enis, eniID)
+	}
+
+	return nil
+}
+
+// eniIdleSinceLocked returns the most recent idleSince timestamp across all
+// addresses and prefixes attached to the ENI, i.e. the time since which all
+// of them have been idle, and false if it has nothing tracked or any of it
+// is still in use
+func eniIdleSinceLocked(state *eniState) (time.Time, bool) {
+	var latest time.Time
+	found := false
+
+	for _, as := range state.addresses {
+		if !as.idle {
+			return time.Time{}, false
+		}
+		if !found || as.idleSince.After(latest) {
+			latest = as.idleSince
+			found = true
+		}
+	}
+
+	for _, ps := range state.prefixes {
+		if !ps.idle {
+			return time.Time{}, false
+		}
+		if !found || ps.idleSince.After(latest) {
+			latest = ps.idleSince
+			found = true
+		}
+	}
+
+	return latest, found
+}
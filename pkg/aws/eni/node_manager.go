@@ -45,8 +45,19 @@ type ec2API interface {
 	CreateNetworkInterface(toAllocate int64, subnetID, desc string, groups []string) (string, error)
 	DeleteNetworkInterface(eniID string) error
 	AttachNetworkInterface(index int64, instanceID, eniID string) (string, error)
+	// DetachNetworkInterface detaches the ENI attachment identified by
+	// attachmentID (as returned by AttachNetworkInterface) from its
+	// instance. It must be called, and the detach allowed to complete,
+	// before DeleteNetworkInterface: EC2 refuses to delete an ENI that is
+	// still attached.
+	DetachNetworkInterface(attachmentID string) error
 	ModifyNetworkInterface(eniID, attachmentID string, deleteOnTermination bool) error
 	AssignPrivateIpAddresses(eniID string, addresses int64) error
+	UnassignPrivateIpAddresses(eniID string, addresses []string) error
+	// AssignPrivateIpPrefixes requests prefixCount /28 IPv4 prefixes on the
+	// given ENI and returns the CIDRs EC2 assigned
+	AssignPrivateIpPrefixes(eniID string, prefixCount int64) ([]string, error)
+	UnassignPrivateIpPrefixes(eniID string, prefixes []string) error
 }
 
 type metricsAPI interface {
@@ -56,6 +67,46 @@ type metricsAPI interface {
 	SetAvailableENIs(available int)
 	SetNodesAtCapacity(nodes int)
 	IncResyncCount()
+	SetAllocatedPrefixes(typ string, allocated int)
+	SetAvailableENIsWithPrefixes(available int)
+}
+
+// ipsPerPrefix is the number of IPv4 addresses in a /28 prefix, as assigned
+// via AssignPrivateIpPrefixes
+const ipsPerPrefix = 16
+
+// RebalanceConfig holds the tunables for the cross-node IP rebalancer and
+// idle-ENI garbage collector that Resync runs on any pass that finds at
+// least one donor node and one recipient node at capacity. They are
+// configurable via the aws-rebalance-high-watermark,
+// aws-excess-ip-release-cooldown and aws-idle-eni-gc-interval operator
+// flags (see pkg/ipam/option) so operators can tune them to their IP churn
+// pattern without a binary rebuild.
+type RebalanceConfig struct {
+	// HighWatermark is the number of idle (available) IPs a node may hold;
+	// a node with no deficit and more idle IPs than this is considered a
+	// donor for cross-node rebalancing, and only the excess above it is
+	// released
+	HighWatermark int
+
+	// ExcessIPReleaseCooldown is the minimum time a secondary IP must have
+	// been idle before it is eligible to be unassigned from a donor node,
+	// to avoid stealing back IPs that were just handed out
+	ExcessIPReleaseCooldown time.Duration
+
+	// IdleENIGCInterval is how long all addresses on an attached ENI must
+	// have been idle before the ENI itself is detached and deleted
+	IdleENIGCInterval time.Duration
+}
+
+// DefaultRebalanceConfig returns the rebalancer tunables used when the
+// operator hasn't overridden them via the aws-rebalance-* flags
+func DefaultRebalanceConfig() RebalanceConfig {
+	return RebalanceConfig{
+		HighWatermark:           8,
+		ExcessIPReleaseCooldown: 15 * time.Minute,
+		IdleENIGCInterval:       30 * time.Minute,
+	}
 }
 
 // nodeMap is a mapping of node names to ENI nodes
@@ -63,24 +114,37 @@ type nodeMap map[string]*Node
 
 // NodeManager manages all nodes with ENIs
 type NodeManager struct {
-	mutex           lock.RWMutex
-	nodes           nodeMap
-	instancesAPI    nodeManagerAPI
-	ec2API          ec2API
-	k8sAPI          k8sAPI
-	metricsAPI      metricsAPI
-	resyncTrigger   *trigger.Trigger
-	deficitResolver *trigger.Trigger
+	mutex            lock.RWMutex
+	nodes            nodeMap
+	instancesAPI     nodeManagerAPI
+	ec2API           ec2API
+	k8sAPI           k8sAPI
+	metricsAPI       metricsAPI
+	eniConfigAPI     eniConfigAPI
+	prefixDelegation bool
+	rebalanceConfig  RebalanceConfig
+	resyncTrigger    *trigger.Trigger
+	deficitResolver  *trigger.Trigger
 }
 
-// NewNodeManager returns a new NodeManager
-func NewNodeManager(instancesAPI nodeManagerAPI, ec2API ec2API, k8sAPI k8sAPI, metrics metricsAPI) (*NodeManager, error) {
+// NewNodeManager returns a new NodeManager. eniConfigAPI may be nil, in
+// which case ENI creation falls back entirely to the CiliumNode spec's own
+// subnet/security-group/AZ defaults. prefixDelegation enables allocating
+// /28 IPv4 prefixes instead of individual secondary IPs on instance types
+// that support it (option.Config.AwsEnablePrefixDelegation), falling back
+// to per-IP allocation otherwise. rebalanceConfig configures the cross-node
+// rebalancer and idle-ENI GC; callers that don't need to override the
+// defaults can pass DefaultRebalanceConfig().
+func NewNodeManager(instancesAPI nodeManagerAPI, ec2API ec2API, k8sAPI k8sAPI, metrics metricsAPI, eniConfigAPI eniConfigAPI, prefixDelegation bool, rebalanceConfig RebalanceConfig) (*NodeManager, error) {
 	mngr := &NodeManager{
-		nodes:        nodeMap{},
-		instancesAPI: instancesAPI,
-		ec2API:       ec2API,
-		k8sAPI:       k8sAPI,
-		metricsAPI:   metrics,
+		nodes:            nodeMap{},
+		instancesAPI:     instancesAPI,
+		ec2API:           ec2API,
+		k8sAPI:           k8sAPI,
+		metricsAPI:       metrics,
+		eniConfigAPI:     eniConfigAPI,
+		prefixDelegation: prefixDelegation,
+		rebalanceConfig:  rebalanceConfig,
 	}
 
 	deficitResolver, err := trigger.NewTrigger(trigger.Parameters{
@@ -195,6 +259,8 @@ func (n *NodeManager) GetNodesByNeededAddresses() []*Node {
 // Kubernetes apiserver.
 func (n *NodeManager) Resync() {
 	var totalUsed, totalAvailable, totalNeeded, remainingInterfaces, nodesAtCapacity int
+	var totalAvailablePrefixes, enisWithPrefixes int
+	var donors, recipients []*Node
 
 	for _, node := range n.GetNodesByNeededAddresses() {
 		node.mutex.Lock()
@@ -206,27 +272,84 @@ func (n *NodeManager) Resync() {
 			fieldName:   node.name,
 			"available": node.stats.availableIPs,
 			"used":      node.stats.usedIPs,
+			"prefixes":  node.stats.availablePrefixes,
 		}).Debug("Recalculated allocation requirements")
 		totalUsed += node.stats.usedIPs
-		availableOnNode := node.stats.availableIPs - node.stats.usedIPs
+		// stats.availableIPs is already idle-only (recalculateLocked never
+		// counts a used address as available), so this is the node's spare
+		// capacity as-is; do not subtract usedIPs again here. Prefixes
+		// count too: neededIPsLocked and unassignSurplusIPs both treat
+		// availableIPs+availablePrefixes as the node's real spare
+		// capacity, so donor/recipient classification must match or a
+		// node allocating exclusively via prefix delegation never looks
+		// like a donor and always looks at-capacity.
+		availableOnNode := node.stats.availableIPs + node.stats.availablePrefixes
 		totalAvailable += availableOnNode
 		totalNeeded += node.stats.neededIPs
 		remainingInterfaces += node.stats.remainingInterfaces
+		totalAvailablePrefixes += node.stats.availablePrefixes
+		if node.stats.availablePrefixes > 0 {
+			enisWithPrefixes++
+		}
 
-		if node.stats.remainingInterfaces == 0 && availableOnNode == 0 {
+		atCapacity := node.stats.remainingInterfaces == 0 && availableOnNode == 0
+		if atCapacity {
 			nodesAtCapacity++
+			recipients = append(recipients, node)
 		}
 		if allocationNeeded && node.stats.remainingInterfaces > 0 {
 			n.deficitResolver.TriggerWithReason(node.name)
 		}
+		if node.stats.neededIPs == 0 && availableOnNode > n.rebalanceConfig.HighWatermark {
+			donors = append(donors, node)
+		}
 		node.mutex.Unlock()
 
 		node.SyncToAPIServer()
 	}
 
+	n.rebalanceDonors(donors, recipients)
+
 	n.metricsAPI.SetAllocatedIPs("used", totalUsed)
 	n.metricsAPI.SetAllocatedIPs("available", totalAvailable)
 	n.metricsAPI.SetAllocatedIPs("needed", totalNeeded)
 	n.metricsAPI.SetAvailableENIs(remainingInterfaces)
 	n.metricsAPI.SetNodesAtCapacity(nodesAtCapacity)
-}
\ No newline at end of file
+
+	if n.prefixDelegation {
+		n.metricsAPI.SetAllocatedPrefixes("available", totalAvailablePrefixes)
+		n.metricsAPI.SetAvailableENIsWithPrefixes(enisWithPrefixes)
+	}
+}
+
+// rebalanceDonors returns IPs stranded on idle donor nodes to the pool so that
+// recipient nodes sitting at capacity can be topped up on the next deficit
+// resolution round. Donor IPs idle for less than ExcessIPReleaseCooldown are
+// left alone so freshly-allocated addresses aren't immediately stolen back,
+// and donor ENIs whose addresses have all been idle for IdleENIGCInterval
+// are detached and deleted entirely to free up per-instance ENI quota. It
+// does nothing unless there is at least one donor and one recipient.
+func (n *NodeManager) rebalanceDonors(donors, recipients []*Node) {
+	if len(donors) == 0 || len(recipients) == 0 {
+		return
+	}
+
+	for _, donor := range donors {
+		released, err := donor.unassignSurplusIPs(n.rebalanceConfig.HighWatermark, n.rebalanceConfig.ExcessIPReleaseCooldown)
+		if err != nil {
+			donor.logger().WithError(err).Warning("Unable to unassign surplus IPs from donor node")
+			continue
+		}
+		if released > 0 {
+			donor.logger().WithField("released", released).Info("Released surplus IPs from donor node")
+		}
+
+		if err := donor.releaseIdleENIs(n.rebalanceConfig.IdleENIGCInterval); err != nil {
+			donor.logger().WithError(err).Warning("Unable to release idle ENI on donor node")
+		}
+	}
+
+	for _, recipient := range recipients {
+		n.deficitResolver.TriggerWithReason(recipient.name)
+	}
+}
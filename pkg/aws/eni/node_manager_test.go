@@ -0,0 +1,147 @@
+// Copyright 2019 Authors of Cilium
+// Copyright 2017 Lyft, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/trigger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeK8sAPI struct{}
+
+func (f *fakeK8sAPI) Update(origResource, newResource *v2.CiliumNode) (*v2.CiliumNode, error) {
+	return newResource, nil
+}
+func (f *fakeK8sAPI) UpdateStatus(origResource, newResource *v2.CiliumNode) (*v2.CiliumNode, error) {
+	return newResource, nil
+}
+
+// newTestDonorAddresses returns count idle addresses that were already
+// idle well before idleFor/cooldown, as they would be by the time a real
+// Resync cycle observes them as stranded surplus capacity
+func newTestDonorAddresses(count int) map[string]*addressState {
+	addresses := make(map[string]*addressState, count)
+	for i := 0; i < count; i++ {
+		addresses[fmt.Sprintf("10.0.0.%d", i)] = &addressState{idle: true, idleSince: time.Now().Add(-time.Hour)}
+	}
+	return addresses
+}
+
+func enisToLive(enis map[string]*eniState) []*v2.ENI {
+	live := make([]*v2.ENI, 0, len(enis))
+	for _, state := range enis {
+		addrs := make([]string, 0, len(state.addresses))
+		for addr := range state.addresses {
+			addrs = append(addrs, addr)
+		}
+		live = append(live, &v2.ENI{ID: state.id, Addresses: addrs})
+	}
+	return live
+}
+
+// TestNodeManagerResyncDrainsDonorsAndRetriggersRecipients drives Resync()
+// over a donor node sitting on stranded surplus capacity and a recipient
+// node at capacity, and asserts the donor's surplus is released while the
+// recipient is queued for a deficit-resolution retry.
+func TestNodeManagerResyncDrainsDonorsAndRetriggersRecipients(t *testing.T) {
+	donorAddresses := newTestDonorAddresses(10)
+	donor := &Node{
+		name: "donor-node",
+		resource: &v2.CiliumNode{
+			Spec: v2.NodeSpec{
+				InstanceID: "i-donor",
+				IPAM:       v2.IPAMSpec{PreAllocate: 2},
+			},
+		},
+		enis: map[string]*eniState{
+			"eni-donor": {id: "eni-donor", addresses: donorAddresses, prefixes: map[string]*prefixState{}},
+		},
+	}
+
+	// recipient has no spare address or ENI capacity left at all: all
+	// maxAttachedENIs of its ENIs are attached but none holds an idle
+	// address, so recalculateLocked will compute availableOnNode == 0 and
+	// remainingInterfaces == 0
+	recipientENIs := map[string]*eniState{}
+	for i := 0; i < maxAttachedENIs; i++ {
+		id := fmt.Sprintf("eni-recipient-%d", i)
+		recipientENIs[id] = &eniState{id: id, addresses: map[string]*addressState{}, prefixes: map[string]*prefixState{}}
+	}
+	recipient := &Node{
+		name: "recipient-node",
+		resource: &v2.CiliumNode{
+			Spec: v2.NodeSpec{
+				InstanceID: "i-recipient",
+				IPAM:       v2.IPAMSpec{PreAllocate: 10},
+			},
+		},
+		enis: recipientENIs,
+	}
+
+	instancesAPI := &fakeNodeManagerAPI{
+		enisByInstance: map[string][]*v2.ENI{
+			"i-donor":     enisToLive(donor.enis),
+			"i-recipient": enisToLive(recipient.enis),
+		},
+	}
+
+	var mu sync.Mutex
+	var retriggered []string
+	deficitResolver, err := trigger.NewTrigger(trigger.Parameters{
+		Name:        "test-eni-node-manager-deficit-resolver",
+		MinInterval: time.Millisecond,
+		TriggerFunc: func(reasons []string) {
+			mu.Lock()
+			retriggered = append(retriggered, reasons...)
+			mu.Unlock()
+		},
+	})
+	assert.NoError(t, err)
+
+	mngr := &NodeManager{
+		nodes:           nodeMap{donor.name: donor, recipient.name: recipient},
+		instancesAPI:    instancesAPI,
+		ec2API:          &fakeEC2API{},
+		k8sAPI:          &fakeK8sAPI{},
+		metricsAPI:      &fakeMetricsAPI{},
+		rebalanceConfig: RebalanceConfig{HighWatermark: 4, ExcessIPReleaseCooldown: time.Millisecond, IdleENIGCInterval: 24 * time.Hour},
+		deficitResolver: deficitResolver,
+	}
+	donor.manager = mngr
+	recipient.manager = mngr
+
+	mngr.Resync()
+
+	assert.Less(t, len(donor.enis["eni-donor"].addresses), 10, "donor's stranded surplus IPs should have been released")
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, reason := range retriggered {
+			if reason == recipient.name {
+				return true
+			}
+		}
+		return false
+	}, 200*time.Millisecond, time.Millisecond, "recipient node should have been re-triggered for deficit resolution")
+}
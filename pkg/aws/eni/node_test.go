@@ -0,0 +1,321 @@
+// Copyright 2019 Authors of Cilium
+// Copyright 2017 Lyft, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/aws/types"
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestNodeResource(preAllocate, minAllocate int) *v2.CiliumNode {
+	return &v2.CiliumNode{
+		Spec: v2.NodeSpec{
+			IPAM: v2.IPAMSpec{
+				PreAllocate: preAllocate,
+				MinAllocate: minAllocate,
+			},
+		},
+	}
+}
+
+func TestNeededIPsLocked(t *testing.T) {
+	tests := []struct {
+		name        string
+		preAllocate int
+		minAllocate int
+		used        int
+		available   int
+		want        int
+	}{
+		{"below pre-allocate watermark", 8, 0, 2, 2, 6},
+		{"at pre-allocate watermark", 8, 0, 2, 8, 0},
+		{"min-allocate dominates pre-allocate", 4, 10, 0, 2, 8},
+		{"nothing needed", 4, 4, 4, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := newTestNodeResource(tt.preAllocate, tt.minAllocate)
+			got := neededIPsLocked(resource, tt.used, tt.available)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNodeUnassignSurplusIPsRespectsCooldown(t *testing.T) {
+	n := &Node{
+		manager: &NodeManager{ec2API: &fakeEC2API{}},
+		enis: map[string]*eniState{
+			"eni-1": {
+				id: "eni-1",
+				addresses: map[string]*addressState{
+					"10.0.0.1": {idle: true, idleSince: time.Now().Add(-time.Hour)},
+					"10.0.0.2": {idle: true, idleSince: time.Now()},
+				},
+			},
+		},
+	}
+	n.stats.availableIPs = 2
+
+	released, err := n.unassignSurplusIPs(0, 15*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, released)
+	assert.Equal(t, 1, n.stats.availableIPs)
+	_, stillTracked := n.enis["eni-1"].addresses["10.0.0.1"]
+	assert.False(t, stillTracked)
+	_, freshStillTracked := n.enis["eni-1"].addresses["10.0.0.2"]
+	assert.True(t, freshStillTracked)
+}
+
+func TestNodeReleaseIdleENIs(t *testing.T) {
+	n := &Node{
+		manager: &NodeManager{ec2API: &fakeEC2API{}},
+		enis: map[string]*eniState{
+			"eni-idle": {
+				id: "eni-idle",
+				addresses: map[string]*addressState{
+					"10.0.0.1": {idle: true, idleSince: time.Now().Add(-time.Hour)},
+				},
+			},
+			"eni-in-use": {
+				id: "eni-in-use",
+				addresses: map[string]*addressState{
+					"10.0.0.2": {idle: false},
+				},
+			},
+		},
+	}
+	n.stats.availableIPs = 1
+
+	err := n.releaseIdleENIs(30 * time.Minute)
+	assert.NoError(t, err)
+
+	_, idleStillAttached := n.enis["eni-idle"]
+	assert.False(t, idleStillAttached)
+	_, inUseStillAttached := n.enis["eni-in-use"]
+	assert.True(t, inUseStillAttached)
+	assert.Equal(t, 0, n.stats.availableIPs)
+}
+
+func TestNodeCreateENILockedUsesMatchedENIConfig(t *testing.T) {
+	pinnedSubnet := &types.Subnet{ID: "subnet-pinned"}
+	instancesAPI := &fakeNodeManagerAPI{subnetsByID: map[string]*types.Subnet{"subnet-pinned": pinnedSubnet}}
+	ec2API := &fakeEC2API{}
+	eniConfigAPI := &fakeENIConfigAPI{
+		byName: map[string]*v2.CiliumENIConfig{
+			"kube-system/pinned": {Spec: v2.CiliumENIConfigSpec{SubnetID: "subnet-pinned", SecurityGroups: []string{"sg-pinned"}}},
+		},
+	}
+
+	n := &Node{
+		name: "node1",
+		manager: &NodeManager{
+			instancesAPI: instancesAPI,
+			ec2API:       ec2API,
+			metricsAPI:   &fakeMetricsAPI{},
+			eniConfigAPI: eniConfigAPI,
+		},
+		resource: &v2.CiliumNode{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "kube-system",
+				Annotations: map[string]string{annotationENIConfig: "pinned"},
+			},
+		},
+		enis: map[string]*eniState{},
+	}
+
+	eniID, err := n.createENILocked()
+	assert.NoError(t, err)
+	assert.Equal(t, "eni-new", eniID)
+	assert.Equal(t, []string{"sg-pinned"}, ec2API.lastSecurityGroups)
+}
+
+func TestInstanceTypeSupportsPrefixDelegation(t *testing.T) {
+	assert.True(t, instanceTypeSupportsPrefixDelegation("m5.large"))
+	assert.True(t, instanceTypeSupportsPrefixDelegation("c6gn.xlarge"))
+	assert.False(t, instanceTypeSupportsPrefixDelegation("t2.micro"))
+	assert.False(t, instanceTypeSupportsPrefixDelegation("m4.large"))
+}
+
+func TestUsedAddressesInPrefix(t *testing.T) {
+	usedIPs := map[string]struct{}{
+		"10.0.1.3":  {},
+		"10.0.1.9":  {},
+		"10.0.2.10": {},
+	}
+
+	count, err := usedAddressesInPrefix("10.0.1.0/28", usedIPs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = usedAddressesInPrefix("not-a-cidr", usedIPs)
+	assert.Error(t, err)
+}
+
+func TestNodeResolveIPDeficitUsesPrefixDelegationWhenSupported(t *testing.T) {
+	ec2API := &fakeEC2API{assignedPrefixesToReturn: []string{"10.0.1.0/28"}}
+	n := &Node{
+		manager: &NodeManager{
+			ec2API:           ec2API,
+			metricsAPI:       &fakeMetricsAPI{},
+			prefixDelegation: true,
+		},
+		resource: &v2.CiliumNode{
+			Spec: v2.NodeSpec{ENI: v2.ENISpec{InstanceType: "m5.large"}},
+		},
+		enis: map[string]*eniState{
+			"eni-1": {id: "eni-1", addresses: map[string]*addressState{}, prefixes: map[string]*prefixState{}},
+		},
+	}
+	n.stats.neededIPs = 5
+
+	err := n.ResolveIPDeficit()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), ec2API.lastAssignedPrefixCount)
+	assert.Equal(t, int64(0), ec2API.lastAssignedIPs)
+	assert.Equal(t, 0, n.stats.neededIPs)
+	assert.Equal(t, ipsPerPrefix, n.stats.availablePrefixes)
+	_, tracked := n.enis["eni-1"].prefixes["10.0.1.0/28"]
+	assert.True(t, tracked)
+}
+
+func TestNodeResolveIPDeficitCapsPerENICapacityAndSpillsToNewENI(t *testing.T) {
+	nearFullAddresses := map[string]*addressState{}
+	for i := 0; i < maxAddressesPerENI-2; i++ {
+		nearFullAddresses[fmt.Sprintf("10.0.0.%d", i)] = &addressState{idle: true}
+	}
+
+	ec2API := &fakeEC2API{}
+	instancesAPI := &fakeNodeManagerAPI{defaultSubnetForTags: &types.Subnet{ID: "subnet-a"}}
+	n := &Node{
+		manager: &NodeManager{
+			instancesAPI: instancesAPI,
+			ec2API:       ec2API,
+			metricsAPI:   &fakeMetricsAPI{},
+		},
+		resource: &v2.CiliumNode{},
+		enis: map[string]*eniState{
+			"eni-near-full": {id: "eni-near-full", addresses: nearFullAddresses, prefixes: map[string]*prefixState{}},
+		},
+	}
+	n.stats.neededIPs = 5
+
+	err := n.ResolveIPDeficit()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n.stats.neededIPs)
+
+	// the near-full ENI only had 2 free slots, so it should have been
+	// capped at 2 and the remaining 3 spilled onto a newly-created ENI
+	// instead of being crammed onto the one ENI with any room at all
+	assert.Len(t, n.enis, 2)
+	newState, ok := n.enis["eni-new"]
+	assert.True(t, ok)
+	assert.Equal(t, maxAddressesPerENI-2, len(n.enis["eni-near-full"].addresses))
+	_ = newState
+}
+
+func TestNodeResolveIPDeficitFallsBackToPerIPForUnsupportedInstanceType(t *testing.T) {
+	ec2API := &fakeEC2API{}
+	n := &Node{
+		manager: &NodeManager{
+			ec2API:           ec2API,
+			metricsAPI:       &fakeMetricsAPI{},
+			prefixDelegation: true,
+		},
+		resource: &v2.CiliumNode{
+			Spec: v2.NodeSpec{ENI: v2.ENISpec{InstanceType: "t2.micro"}},
+		},
+		enis: map[string]*eniState{
+			"eni-1": {id: "eni-1", addresses: map[string]*addressState{}, prefixes: map[string]*prefixState{}},
+		},
+	}
+	n.stats.neededIPs = 5
+
+	err := n.ResolveIPDeficit()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ec2API.lastAssignedPrefixCount)
+	assert.Equal(t, int64(5), ec2API.lastAssignedIPs)
+	assert.Equal(t, 0, n.stats.neededIPs)
+}
+
+type fakeNodeManagerAPI struct {
+	subnetsByID          map[string]*types.Subnet
+	defaultSubnetForTags *types.Subnet
+	enisByInstance       map[string][]*v2.ENI
+}
+
+func (f *fakeNodeManagerAPI) GetENI(instanceID string, index int) *v2.ENI { return nil }
+func (f *fakeNodeManagerAPI) GetENIs(instanceID string) []*v2.ENI {
+	return f.enisByInstance[instanceID]
+}
+func (f *fakeNodeManagerAPI) GetSubnet(subnetID string) *types.Subnet { return f.subnetsByID[subnetID] }
+func (f *fakeNodeManagerAPI) FindSubnetByTags(vpcID, availabilityZone string, required types.Tags) *types.Subnet {
+	return f.defaultSubnetForTags
+}
+func (f *fakeNodeManagerAPI) Resync() {}
+
+type fakeMetricsAPI struct{}
+
+func (f *fakeMetricsAPI) IncENIAllocationAttempt(status, subnetID string)  {}
+func (f *fakeMetricsAPI) AddIPAllocation(subnetID string, allocated int64) {}
+func (f *fakeMetricsAPI) SetAllocatedIPs(typ string, allocated int)        {}
+func (f *fakeMetricsAPI) SetAvailableENIs(available int)                   {}
+func (f *fakeMetricsAPI) SetNodesAtCapacity(nodes int)                     {}
+func (f *fakeMetricsAPI) IncResyncCount()                                  {}
+func (f *fakeMetricsAPI) SetAllocatedPrefixes(typ string, allocated int)   {}
+func (f *fakeMetricsAPI) SetAvailableENIsWithPrefixes(available int)       {}
+
+type fakeEC2API struct {
+	lastAssignedIPs          int64
+	lastAssignedPrefixCount  int64
+	assignedPrefixesToReturn []string
+	lastSecurityGroups       []string
+}
+
+func (f *fakeEC2API) CreateNetworkInterface(toAllocate int64, subnetID, desc string, groups []string) (string, error) {
+	f.lastSecurityGroups = groups
+	return "eni-new", nil
+}
+func (f *fakeEC2API) DeleteNetworkInterface(eniID string) error { return nil }
+func (f *fakeEC2API) AttachNetworkInterface(index int64, instanceID, eniID string) (string, error) {
+	return "attachment-1", nil
+}
+func (f *fakeEC2API) DetachNetworkInterface(attachmentID string) error { return nil }
+func (f *fakeEC2API) ModifyNetworkInterface(eniID, attachmentID string, deleteOnTermination bool) error {
+	return nil
+}
+func (f *fakeEC2API) AssignPrivateIpAddresses(eniID string, addresses int64) error {
+	f.lastAssignedIPs = addresses
+	return nil
+}
+func (f *fakeEC2API) UnassignPrivateIpAddresses(eniID string, addresses []string) error {
+	return nil
+}
+func (f *fakeEC2API) AssignPrivateIpPrefixes(eniID string, prefixCount int64) ([]string, error) {
+	f.lastAssignedPrefixCount = prefixCount
+	return f.assignedPrefixesToReturn, nil
+}
+func (f *fakeEC2API) UnassignPrivateIpPrefixes(eniID string, prefixes []string) error {
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package delegated implements the IPAM allocator used in CNI chaining
+// mode, where cilium-agent is installed alongside an already-functioning
+// CNI plugin (e.g. flannel, host-local, or a cluster's default CNI) and
+// delegates IP address management to it instead of allocating IPs itself.
+// Cilium's datapath (eBPF programs, identity, policy) is then wrapped
+// around the interface and IP the delegate plugin hands back.
+package delegated
+
+import (
+	"context"
+	"fmt"
+
+	cniInvoke "github.com/containernetworking/cni/pkg/invoke"
+	cniTypesCurrent "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "ipam-delegated")
+
+// defaultCNIBinDir is where cilium-agent looks up the delegate plugin
+// binary, matching the default search path used by kubelet/CNI itself
+const defaultCNIBinDir = "/opt/cni/bin"
+
+// AllocationResult mirrors the subset of pkg/ipam's AllocationResult that
+// the delegate path can populate from a CNI ADD response
+type AllocationResult struct {
+	// IP is the address the delegate plugin assigned to the interface
+	IP string
+
+	// Interface is the name of the veth/interface the delegate plugin
+	// created inside the pod netns. Cilium's own endpoint setup must reuse
+	// this interface rather than creating its own veth, since the delegate
+	// plugin already wired it into the container netns.
+	Interface string
+
+	// Gateway is the gateway address reported by the delegate plugin, if
+	// any
+	Gateway string
+
+	// DelegateNetConf is the delegate plugin's own NetConf stanza as it was
+	// actually passed to ADD, marshaled so it can be cached by the caller
+	// (e.g. alongside the CNI result) and replayed verbatim to Release.
+	// CNI DEL calls are not guaranteed to see the same stdin the matching
+	// ADD did, so the allocator cannot simply reuse its own cfg.NetConf at
+	// release time.
+	DelegateNetConf []byte
+}
+
+// CNIChainingMode identifies how cilium-cni is chained with the upstream
+// CNI plugin that actually owns IP allocation. It is read from the
+// cni-chaining-mode field of the CNI conflist cilium-cni is invoked with.
+type CNIChainingMode string
+
+const (
+	// CNIChainingModeGeneric chains with an arbitrary CNI plugin by name:
+	// the delegate's binary and NetConf are taken as-is, with no
+	// mode-specific adjustments. This is the only chaining mode this
+	// package currently implements.
+	CNIChainingModeGeneric CNIChainingMode = "generic-veth"
+)
+
+// Config holds the delegated IPAM allocator's configuration, populated from
+// the cni-chaining-mode conf passed to cilium-cni
+type Config struct {
+	// ChainingMode selects which upstream CNI plugin cilium-cni is
+	// chained with. Defaults to CNIChainingModeGeneric.
+	ChainingMode CNIChainingMode
+
+	// PluginName is the delegate CNI plugin binary to invoke, e.g.
+	// "flannel" or "host-local". It is looked up under BinDir.
+	PluginName string
+
+	// BinDir overrides the directory delegate plugin binaries are looked
+	// up in. Defaults to defaultCNIBinDir.
+	BinDir string
+
+	// NetConf is the raw CNI network configuration to pass through to the
+	// delegate plugin unmodified
+	NetConf []byte
+}
+
+// Allocator implements the delegated IPAM mode: rather than allocating IPs
+// itself, it shells out to an upstream CNI plugin using the standard CNI
+// ADD/DEL protocol and returns whatever address that plugin assigned.
+type Allocator struct {
+	cfg Config
+}
+
+// NewAllocator returns a delegated IPAM allocator for the given chained CNI
+// plugin configuration. It returns an error if cfg.ChainingMode is set to
+// anything other than CNIChainingModeGeneric, the only mode this package
+// currently implements.
+func NewAllocator(cfg Config) (*Allocator, error) {
+	if cfg.BinDir == "" {
+		cfg.BinDir = defaultCNIBinDir
+	}
+	if cfg.ChainingMode == "" {
+		cfg.ChainingMode = CNIChainingModeGeneric
+	}
+	if cfg.ChainingMode != CNIChainingModeGeneric {
+		return nil, fmt.Errorf("unsupported CNI chaining mode %q", cfg.ChainingMode)
+	}
+	return &Allocator{cfg: cfg}, nil
+}
+
+// Allocate invokes the delegate plugin's CNI ADD command for the given
+// container/netns and returns the IP and interface it assigned. The
+// returned AllocationResult is what endpoint creation must use to wire up
+// the pod's datapath: the interface and IP come from the delegate, not from
+// Cilium's own veth setup, since the delegate plugin already created and
+// attached the interface inside the netns.
+func (a *Allocator) Allocate(ctx context.Context, containerID, netns, ifName string) (*AllocationResult, error) {
+	pluginPath, err := cniInvoke.FindInPath(a.cfg.PluginName, []string{a.cfg.BinDir})
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate delegate CNI plugin %q: %s", a.cfg.PluginName, err)
+	}
+
+	rt := &cniInvoke.Args{
+		Command:     "ADD",
+		ContainerID: containerID,
+		NetNS:       netns,
+		IfName:      ifName,
+		Path:        a.cfg.BinDir,
+	}
+
+	res, err := cniInvoke.ExecPluginWithResult(ctx, pluginPath, a.cfg.NetConf, rt, nil)
+	if err != nil {
+		return nil, fmt.Errorf("delegate CNI plugin %q ADD failed: %s", a.cfg.PluginName, err)
+	}
+
+	result, err := cniTypesCurrent.NewResultFromResult(res)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse delegate CNI plugin result: %s", err)
+	}
+
+	allocation, err := parseResult(result)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the NetConf bytes actually passed to ADD, not a synthesized
+	// stand-in: DEL must replay whatever ADD saw, which may carry fields
+	// (bridge name, subnet, an ipam stanza, ...) well beyond CNIVersion,
+	// Name and Type
+	allocation.DelegateNetConf = a.cfg.NetConf
+
+	return allocation, nil
+}
+
+// Release invokes the delegate plugin's CNI DEL command, returning the IP it
+// had previously assigned to the kernel's address pool. delegateNetConf must
+// be the AllocationResult.DelegateNetConf that was returned by the Allocate
+// call this Release is undoing, not a.cfg.NetConf: CNI DEL is not guaranteed
+// to run with the same stdin the matching ADD did, so the original
+// allocation's own netconf is what must be replayed to the delegate. When
+// delegateNetConf is empty, a.cfg.NetConf is passed to the delegate instead.
+func (a *Allocator) Release(ctx context.Context, containerID, netns, ifName string, delegateNetConf []byte) error {
+	pluginPath, err := cniInvoke.FindInPath(a.cfg.PluginName, []string{a.cfg.BinDir})
+	if err != nil {
+		return fmt.Errorf("unable to locate delegate CNI plugin %q: %s", a.cfg.PluginName, err)
+	}
+
+	if len(delegateNetConf) == 0 {
+		delegateNetConf = a.cfg.NetConf
+	}
+
+	rt := &cniInvoke.Args{
+		Command:     "DEL",
+		ContainerID: containerID,
+		NetNS:       netns,
+		IfName:      ifName,
+		Path:        a.cfg.BinDir,
+	}
+
+	if err := cniInvoke.ExecPluginWithoutResult(ctx, pluginPath, delegateNetConf, rt, nil); err != nil {
+		return fmt.Errorf("delegate CNI plugin %q DEL failed: %s", a.cfg.PluginName, err)
+	}
+
+	return nil
+}
+
+func parseResult(result *cniTypesCurrent.Result) (*AllocationResult, error) {
+	if len(result.IPs) == 0 {
+		return nil, fmt.Errorf("delegate CNI plugin returned no IP configuration")
+	}
+
+	ipConf := result.IPs[0]
+	allocation := &AllocationResult{
+		IP: ipConf.Address.IP.String(),
+	}
+	if ipConf.Gateway != nil {
+		allocation.Gateway = ipConf.Gateway.String()
+	}
+	if ipConf.Interface != nil && *ipConf.Interface < len(result.Interfaces) {
+		allocation.Interface = result.Interfaces[*ipConf.Interface].Name
+	}
+
+	return allocation, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delegated
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAllocatorDefaultsChainingMode(t *testing.T) {
+	a, err := NewAllocator(Config{PluginName: "flannel"})
+	assert.NoError(t, err)
+	assert.Equal(t, CNIChainingModeGeneric, a.cfg.ChainingMode)
+
+	a, err = NewAllocator(Config{PluginName: "flannel", ChainingMode: CNIChainingModeGeneric})
+	assert.NoError(t, err)
+	assert.Equal(t, CNIChainingModeGeneric, a.cfg.ChainingMode)
+}
+
+func TestNewAllocatorRejectsUnsupportedChainingMode(t *testing.T) {
+	a, err := NewAllocator(Config{PluginName: "flannel", ChainingMode: "custom-mode"})
+	assert.Error(t, err)
+	assert.Nil(t, a)
+}
+
+func TestReleaseFailsWhenDelegatePluginNotFound(t *testing.T) {
+	a, err := NewAllocator(Config{PluginName: "flannel", NetConf: []byte(`{"cniVersion":"1.0.0","name":"flannel","type":"flannel"}`)})
+	assert.NoError(t, err)
+
+	// No DelegateNetConf is passed, as after cilium-agent restarted and lost
+	// its CNI result cache. There is no "flannel" binary on the test host,
+	// so Release fails at FindInPath, before the fallback to a.cfg.NetConf
+	// is reached.
+	err = a.Release(context.Background(), "container1", "/proc/1/ns/net", "eth0", nil)
+	assert.Error(t, err)
+}
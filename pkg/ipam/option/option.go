@@ -8,6 +8,10 @@ const (
 	// option.IPAM
 	IPAMAzure = "azure"
 
+	// IPAMAlibabaCloud is the value to select the AlibabaCloud ENI IPAM
+	// plugin for option.IPAM
+	IPAMAlibabaCloud = "alibabacloud"
+
 	// IPAMHostScopeLegacy is the value to select the legacy hostscope IPAM mode
 	// This option will disappear in Cilium v1.9
 	IPAMHostScopeLegacy = "hostscope-legacy"
@@ -19,4 +23,35 @@ const (
 	// IPAMCRD is the value to select the CRD-backed IPAM plugin for
 	// option.IPAM
 	IPAMCRD = "crd"
+
+	// IPAMDelegated is the value to select the delegated IPAM mode, in
+	// which cilium-agent does not allocate IPs itself but instead invokes
+	// an upstream chained CNI plugin to do so
+	IPAMDelegated = "delegated"
+)
+
+const (
+	// AwsEnablePrefixDelegation is the name of the operator flag that
+	// enables allocating /28 IPv4 prefixes (16 secondary IPs each) on ENIs
+	// instead of individual secondary IPs, on AWS instance types that
+	// support it. Instance types without prefix delegation support
+	// transparently fall back to per-IP allocation.
+	AwsEnablePrefixDelegation = "aws-enable-prefix-delegation"
+
+	// AwsRebalanceHighWatermark is the name of the operator flag that sets
+	// eni.RebalanceConfig.HighWatermark: the number of idle IPs a node may
+	// hold before it is considered a donor for cross-node rebalancing
+	AwsRebalanceHighWatermark = "aws-rebalance-high-watermark"
+
+	// AwsExcessIPReleaseCooldown is the name of the operator flag that sets
+	// eni.RebalanceConfig.ExcessIPReleaseCooldown: the minimum time a
+	// secondary IP must have been idle before it is eligible to be
+	// unassigned from a donor node
+	AwsExcessIPReleaseCooldown = "aws-excess-ip-release-cooldown"
+
+	// AwsIdleENIGCInterval is the name of the operator flag that sets
+	// eni.RebalanceConfig.IdleENIGCInterval: how long all addresses on an
+	// attached ENI must have been idle before the ENI itself is detached
+	// and deleted
+	AwsIdleENIGCInterval = "aws-idle-eni-gc-interval"
 )